@@ -0,0 +1,50 @@
+package atc
+
+import "time"
+
+// ContainerRetention configures how many of a job's build containers the
+// container reaper keeps around (rather than releasing their infinite TTL)
+// once a build finishes, and the hard cap on how long any container may
+// stick around regardless of build status.
+type ContainerRetention struct {
+	RawKeepSuccessful *int `yaml:"keep_successful,omitempty" json:"keep_successful,omitempty"`
+	RawKeepFailed     *int `yaml:"keep_failed,omitempty" json:"keep_failed,omitempty"`
+
+	RawMaxAge string `yaml:"max_age,omitempty" json:"max_age,omitempty"`
+}
+
+// KeepSuccessful is the number of successful builds' containers to keep per
+// job, defaulting to 0 (today's behavior of releasing them immediately).
+func (cr ContainerRetention) KeepSuccessful() int {
+	if cr.RawKeepSuccessful == nil {
+		return 0
+	}
+
+	return *cr.RawKeepSuccessful
+}
+
+// KeepFailed is the number of failed builds' containers to keep per job,
+// defaulting to 1 (today's behavior of keeping only the most recent
+// failure).
+func (cr ContainerRetention) KeepFailed() int {
+	if cr.RawKeepFailed == nil {
+		return 1
+	}
+
+	return *cr.RawKeepFailed
+}
+
+// MaxAge is the longest a container may live regardless of its build's
+// status, or 0 if unset.
+func (cr ContainerRetention) MaxAge() time.Duration {
+	if cr.RawMaxAge == "" {
+		return 0
+	}
+
+	maxAge, err := time.ParseDuration(cr.RawMaxAge)
+	if err != nil {
+		return 0
+	}
+
+	return maxAge
+}
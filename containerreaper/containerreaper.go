@@ -1,16 +1,51 @@
 package containerreaper
 
 import (
+	"context"
 	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/lib/pq"
+	"github.com/tedsuo/ifrit"
+	"golang.org/x/time/rate"
+
+	"github.com/concourse/atc"
 	"github.com/concourse/atc/db"
+	"github.com/concourse/atc/metric"
 	"github.com/concourse/atc/worker"
 	"github.com/pivotal-golang/lager"
 )
 
+// defaultInterval is used when NewContainerReaper is given a zero interval.
+const defaultInterval = 30 * time.Second
+
+// maxBackoffInterval caps how long the reaper will back off between runs
+// after repeated DB errors.
+const maxBackoffInterval = 5 * time.Minute
+
+// defaultWorkerConcurrency is used when NewContainerReaper is given a zero
+// concurrency.
+const defaultWorkerConcurrency = 5
+
+// ErrWorkerContainerNotFound is returned by updateWorkerContainerTTL when
+// the worker has no knowledge of the container. release() treats this as
+// success, since the end state we wanted (no infinite-TTL container taking
+// up space) already holds; it's the DB row that needs cleaning up.
+var ErrWorkerContainerNotFound = errors.New("worker-container-not-found")
+
 type ContainerReaper interface {
-	Run() error
+	ifrit.Runner
+}
+
+// Listener is satisfied by *pq.Listener. It is abstracted out so the reaper
+// can be driven by a fake in tests instead of a real Postgres connection.
+type Listener interface {
+	Listen(channel string) error
+	NotificationChannel() <-chan *pq.Notification
 }
 
 //go:generate counterfeiter . ContainerReaperDB
@@ -20,14 +55,27 @@ type ContainerReaperDB interface {
 	FindOrphanContainersWithInfiniteTTL() ([]db.SavedContainer, error)
 	FindContainersFromSuccessfulBuildsWithInfiniteTTL() ([]db.SavedContainer, error)
 	FindContainersFromUnsuccessfulBuildsWithInfiniteTTL() ([]db.SavedContainer, error)
+	FindContainersFromSuccessfulBuildsWithInfiniteTTLForJob(jobID int) ([]db.SavedContainer, error)
+	FindContainersFromUnsuccessfulBuildsWithInfiniteTTLForJob(jobID int) ([]db.SavedContainer, error)
 	UpdateExpiresAtOnContainer(handle string, ttl time.Duration) error
 }
 
+// LeaseName is the well-known db.Lease name for the reaper's lease, so that
+// only one ATC instance in the cluster is ever reaping containers at a time.
+const LeaseName = "container-reaper"
+
 type containerReaper struct {
 	logger            lager.Logger
 	workerClient      worker.Client
 	db                ContainerReaperDB
 	pipelineDBFactory db.PipelineDBFactory
+	listener          Listener
+	lease             db.Lease
+	interval          time.Duration
+	workerConcurrency int
+	releaseLimiter    *rate.Limiter
+
+	wg sync.WaitGroup
 }
 
 func NewContainerReaper(
@@ -35,12 +83,30 @@ func NewContainerReaper(
 	workerClient worker.Client,
 	db ContainerReaperDB,
 	pipelineDBFactory db.PipelineDBFactory,
+	listener Listener,
+	lease db.Lease,
+	interval time.Duration,
+	workerConcurrency int,
+	releaseLimiter *rate.Limiter,
 ) ContainerReaper {
+	if interval == 0 {
+		interval = defaultInterval
+	}
+
+	if workerConcurrency == 0 {
+		workerConcurrency = defaultWorkerConcurrency
+	}
+
 	return &containerReaper{
 		logger:            logger,
 		workerClient:      workerClient,
 		db:                db,
 		pipelineDBFactory: pipelineDBFactory,
+		listener:          listener,
+		lease:             lease,
+		interval:          interval,
+		workerConcurrency: workerConcurrency,
+		releaseLimiter:    releaseLimiter,
 	}
 }
 
@@ -52,123 +118,402 @@ func (cr *containerReaper) updateWorkerContainerTTL(handle string) error {
 	}
 
 	if !found {
-		cr.logger.Error("worker-containerr-not-found", nil)
-		return errors.New("worker-container-not-found")
+		cr.logger.Debug("worker-container-not-found")
+		return ErrWorkerContainerNotFound
 	}
 
 	workerContainer.Release(worker.FinalTTL(worker.ContainerTTL))
 	return nil
 }
 
+// release is idempotent: a container the worker has already forgotten
+// about is treated as already released, so the DB row's TTL still gets
+// updated instead of leaving it to be retried forever.
 func (cr *containerReaper) release(handle string) error {
+	cr.wg.Add(1)
+	defer cr.wg.Done()
+
+	if cr.releaseLimiter != nil {
+		if err := cr.releaseLimiter.Wait(context.Background()); err != nil {
+			return err
+		}
+	}
+
 	err := cr.updateWorkerContainerTTL(handle)
-	if err != nil {
+	if err != nil && err != ErrWorkerContainerNotFound {
 		return err
 	}
 
 	err = cr.db.UpdateExpiresAtOnContainer(handle, worker.ContainerTTL)
 	if err != nil {
 		cr.logger.Error("error-updating-db-container-ttl", err)
+		return err
+	}
+
+	return nil
+}
+
+// Run makes the container reaper an ifrit.Runner: it reaps on a loop,
+// either driven by LISTEN/NOTIFY or by ticking every interval, until it
+// receives a signal. On shutdown it stops scheduling new runs and waits
+// for any release() calls already in flight to finish before returning.
+func (cr *containerReaper) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	close(ready)
+
+	defer cr.wg.Wait()
+
+	if cr.listener != nil {
+		return cr.watch(signals)
+	}
+
+	return cr.poll(signals)
+}
+
+// poll runs a full scan every interval, backing off exponentially (up to
+// maxBackoffInterval) after a failed run and resetting back to interval
+// once a run succeeds.
+func (cr *containerReaper) poll(signals <-chan os.Signal) error {
+	backoff := cr.interval
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-signals:
+			return nil
+
+		case <-timer.C:
+			err := cr.runWithLease(cr.fullScan)
+			if err != nil {
+				cr.logger.Error("container-reaper-run-failed", err)
+
+				backoff *= 2
+				if backoff > maxBackoffInterval {
+					backoff = maxBackoffInterval
+				}
+			} else {
+				backoff = cr.interval
+			}
+
+			timer.Reset(backoff)
+		}
+	}
+}
+
+// watch subscribes to the containers_changed notification channel and reaps
+// only the job that changed, instead of scanning every container with an
+// infinite TTL on every tick. If the listener errors out or its connection
+// is re-established (which Postgres signals with a nil notification), it
+// falls back to a full scan so no job is permanently missed.
+//
+// TODO: as of this writing nothing in the db package actually publishes to
+// containers_changed (see the TODO on db.notifyContainersChanged), so in
+// practice watch() never receives a real per-job notification and every
+// reap happens through the reconnect fallback above. Event-driven reaping
+// is not yet live end to end.
+func (cr *containerReaper) watch(signals <-chan os.Signal) error {
+	err := cr.listener.Listen(db.ContainersChannel)
+	if err != nil {
+		cr.logger.Error("failed-to-listen-for-container-changes", err)
+		return cr.poll(signals)
+	}
+
+	notifications := cr.listener.NotificationChannel()
+
+	for {
+		select {
+		case <-signals:
+			return nil
+
+		case notification, ok := <-notifications:
+			if !ok {
+				cr.logger.Error("listener-channel-closed", nil)
+				return cr.poll(signals)
+			}
+
+			if notification == nil {
+				// the listener reconnected and may have missed
+				// notifications while it was down; fall back to a full
+				// scan to be safe
+				if err := cr.runWithLease(cr.fullScan); err != nil {
+					cr.logger.Error("failed-to-run-fallback-scan", err)
+				}
+				continue
+			}
+
+			jobID, err := strconv.Atoi(notification.Extra)
+			if err != nil {
+				cr.logger.Error("failed-to-parse-job-id", err, lager.Data{"payload": notification.Extra})
+				continue
+			}
+
+			if err := cr.runWithLease(func() error { return cr.reapJob(jobID) }); err != nil {
+				cr.logger.Error("failed-to-reap-job", err, lager.Data{"job-id": jobID})
+			}
+		}
+	}
+}
+
+// runWithLease signs the reaper's db.Lease, if one is configured, before
+// invoking run, so only one ATC instance in the cluster ever reaps
+// containers at a time. If the lease can't be acquired, run is skipped
+// entirely and the skip is logged at debug.
+func (cr *containerReaper) runWithLease(run func() error) error {
+	if cr.lease == nil {
+		return run()
+	}
+
+	acquired, err := cr.lease.AttemptSign()
+	if err != nil {
+		cr.logger.Error("failed-to-acquire-container-reaper-lease", err)
+		return err
 	}
-	return err
+
+	if !acquired {
+		cr.logger.Debug("did-not-acquire-container-reaper-lease")
+		return nil
+	}
+
+	defer cr.lease.Break()
+
+	return run()
 }
 
-func (cr *containerReaper) Run() error {
+// fullScan is the un-targeted scan-everything behavior the reaper used
+// before it could be driven by LISTEN/NOTIFY. It also emits the reaper's
+// per-run metrics.
+func (cr *containerReaper) fullScan() error {
+	start := time.Now()
+	result := &reapResult{errs: &multiError{}}
+
+	defer func() {
+		metric.ContainersScanned{Count: result.scanned}.Emit(cr.logger)
+		metric.ContainersReleased{Count: result.released}.Emit(cr.logger)
+		metric.ContainerReleaseFailures{Count: result.failures}.Emit(cr.logger)
+		metric.ContainerReaperRunDuration{Duration: time.Since(start)}.Emit(cr.logger)
+	}()
+
 	successfulContainers, err := cr.db.FindContainersFromSuccessfulBuildsWithInfiniteTTL()
-	cr.logger.Error("running-container-reaper", nil)
 	if err != nil {
 		cr.logger.Error("failed-to-find-successful-containers", err)
-	} else {
-		for _, container := range successfulContainers {
-			cr.logger.Error("successful-container: ", nil, lager.Data{"pipeline": container.PipelineID})
-			cr.release(container.Handle)
-		}
+		result.errs.Add(err)
 	}
 
 	failedContainers, err := cr.db.FindContainersFromUnsuccessfulBuildsWithInfiniteTTL()
 	if err != nil {
 		cr.logger.Error("failed-to-find-unsuccessful-containers", err)
+		result.errs.Add(err)
+		return result.errs.ErrorOrNil()
+	}
+
+	result.scanned = len(successfulContainers) + len(failedContainers)
+
+	cr.reapJobContainers(successfulContainers, failedContainers, result)
+
+	return result.errs.ErrorOrNil()
+}
+
+// reapJob scans only the containers belonging to the given job, triggered
+// by a containers_changed notification for that job.
+func (cr *containerReaper) reapJob(jobID int) error {
+	start := time.Now()
+	result := &reapResult{errs: &multiError{}}
+
+	defer func() {
+		metric.ContainersScanned{Count: result.scanned}.Emit(cr.logger)
+		metric.ContainersReleased{Count: result.released}.Emit(cr.logger)
+		metric.ContainerReleaseFailures{Count: result.failures}.Emit(cr.logger)
+		metric.ContainerReaperRunDuration{Duration: time.Since(start)}.Emit(cr.logger)
+	}()
+
+	successfulContainers, err := cr.db.FindContainersFromSuccessfulBuildsWithInfiniteTTLForJob(jobID)
+	if err != nil {
 		return err
 	}
 
-	failedJobContainerMap := cr.buildFailedMap(failedContainers)
-	successfulJobContainerMap := cr.buildSuccessMap(successfulContainers)
+	failedContainers, err := cr.db.FindContainersFromUnsuccessfulBuildsWithInfiniteTTLForJob(jobID)
+	if err != nil {
+		return err
+	}
+
+	result.scanned = len(successfulContainers) + len(failedContainers)
+
+	cr.reapJobContainers(successfulContainers, failedContainers, result)
+
+	return result.errs.ErrorOrNil()
+}
+
+// reapResult accumulates what a single run did, so it can be reported as
+// metrics and returned as a combined error instead of being swallowed.
+type reapResult struct {
+	scanned  int
+	released int
+	failures int
+	errs     *multiError
+
+	mu      sync.Mutex
+	pending []db.SavedContainer
+}
+
+// queueRelease defers releasing a container until flushReleases, so the
+// whole run's releases can be grouped by worker and fanned out together
+// instead of happening one at a time as they're discovered.
+func (result *reapResult) queueRelease(container db.SavedContainer) {
+	result.mu.Lock()
+	result.pending = append(result.pending, container)
+	result.mu.Unlock()
+}
+
+func (result *reapResult) recordRelease(err error) {
+	result.mu.Lock()
+	defer result.mu.Unlock()
+
+	if err != nil {
+		result.failures++
+		result.errs.Add(err)
+		return
+	}
+
+	result.released++
+}
+
+// reapJobContainers applies each job's container_retention policy: the
+// newest KeepSuccessful successful builds' containers and the newest
+// KeepFailed failed builds' containers are left alone, everything else is
+// released. Containers older than MaxAge are released regardless of where
+// they rank, since an operator wants those gone no matter what.
+func (cr *containerReaper) reapJobContainers(successfulContainers, failedContainers []db.SavedContainer, result *reapResult) {
+	successfulJobContainerMap, retentionMap := cr.buildSuccessMap(successfulContainers, result)
+	failedJobContainerMap, failedRetentionMap := cr.buildFailedMap(failedContainers, result)
+
+	for jobID, retention := range failedRetentionMap {
+		retentionMap[jobID] = retention
+	}
+
+	for jobID, jobContainers := range successfulJobContainerMap {
+		cr.queueBeyondRetention(jobContainers, retentionMap[jobID].KeepSuccessful(), retentionMap[jobID].MaxAge(), result)
+	}
 
 	for jobID, jobContainers := range failedJobContainerMap {
-		maxFailedBuildID := -1
-		for _, jobContainer := range jobContainers {
-			if jobContainer.BuildID > maxFailedBuildID {
-				maxFailedBuildID = jobContainer.BuildID
-			}
-		}
+		cr.queueBeyondRetention(jobContainers, retentionMap[jobID].KeepFailed(), retentionMap[jobID].MaxAge(), result)
+	}
 
-		for _, jobContainer := range jobContainers {
-			maxSuccessfulBuildID := successfulJobContainerMap[jobID]
+	cr.flushReleases(result)
+}
 
-			if maxSuccessfulBuildID > maxFailedBuildID || maxFailedBuildID > jobContainer.BuildID {
-				handle := jobContainer.Container.Handle
-				cr.release(handle)
-			}
+// queueBeyondRetention keeps the `keep` newest builds' containers (sorted
+// by build ID) and queues the rest for release, as well as any container
+// whose handle is older than maxAge.
+func (cr *containerReaper) queueBeyondRetention(containers []db.SavedContainer, keep int, maxAge time.Duration, result *reapResult) {
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].BuildID > containers[j].BuildID
+	})
+
+	builds := 0
+	for i, container := range containers {
+		if i == 0 || container.BuildID != containers[i-1].BuildID {
+			builds++
 		}
+
+		if builds <= keep && !olderThan(container, maxAge) {
+			continue
+		}
+
+		result.queueRelease(container)
 	}
+}
 
-	return nil
+// flushReleases groups every container queued this run by the worker it
+// lives on, then releases each worker's containers through a bounded pool
+// of cr.workerConcurrency goroutines so one slow/overloaded worker can't
+// starve the others. A shared rate limiter (set on the reaper, not here)
+// caps the total release RPS across every worker.
+func (cr *containerReaper) flushReleases(result *reapResult) {
+	byWorker := make(map[string][]db.SavedContainer)
+	for _, container := range result.pending {
+		byWorker[container.WorkerName] = append(byWorker[container.WorkerName], container)
+	}
+
+	var workersWg sync.WaitGroup
+
+	for _, containers := range byWorker {
+		containers := containers
+
+		workersWg.Add(1)
+		go func() {
+			defer workersWg.Done()
+			cr.releaseWorkerQueue(containers, result)
+		}()
+	}
+
+	workersWg.Wait()
 }
 
-func (cr *containerReaper) buildSuccessMap(containers []db.SavedContainer) map[int]int {
-	var jobContainerMap map[int]int
-	jobContainerMap = make(map[int]int)
+// releaseWorkerQueue releases a single worker's queue of containers through
+// a pool of up to cr.workerConcurrency goroutines.
+func (cr *containerReaper) releaseWorkerQueue(containers []db.SavedContainer, result *reapResult) {
+	sem := make(chan struct{}, cr.workerConcurrency)
+
+	var wg sync.WaitGroup
+
+	for _, container := range containers {
+		handle := container.Container.Handle
+
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result.recordRelease(cr.release(handle))
+		}()
+	}
+
+	wg.Wait()
+}
 
-	if containers == nil {
-		return jobContainerMap
+func olderThan(container db.SavedContainer, maxAge time.Duration) bool {
+	if maxAge == 0 {
+		return false
 	}
 
+	return time.Since(container.Container.CreatedAt) > maxAge
+}
+
+func (cr *containerReaper) buildSuccessMap(containers []db.SavedContainer, result *reapResult) (map[int][]db.SavedContainer, map[int]atc.ContainerRetention) {
+	jobContainerMap := make(map[int][]db.SavedContainer)
+	retentionMap := make(map[int]atc.ContainerRetention)
+
 	for _, container := range containers {
 		buildID := container.BuildID
 		jobID, found, err := cr.db.FindJobIDForBuild(buildID)
 		if err != nil || !found {
 			cr.logger.Error("find-job-id-for-build", err, lager.Data{"build-id": buildID, "found": found})
-			cr.release(container.Handle)
+			result.queueRelease(container)
 			continue
 		}
 
-		maxSuccessfulBuildID := jobContainerMap[jobID]
-		if buildID > maxSuccessfulBuildID {
-			jobContainerMap[jobID] = buildID
+		jobConfig, found := cr.findJobConfig(container)
+		if found {
+			retentionMap[jobID] = jobConfig.ContainerRetention
 		}
+
+		jobContainerMap[jobID] = append(jobContainerMap[jobID], container)
 	}
 
-	return jobContainerMap
+	return jobContainerMap, retentionMap
 }
 
-func (cr *containerReaper) buildFailedMap(containers []db.SavedContainer) map[int][]db.SavedContainer {
-	var jobContainerMap map[int][]db.SavedContainer
-	jobContainerMap = make(map[int][]db.SavedContainer)
+func (cr *containerReaper) buildFailedMap(containers []db.SavedContainer, result *reapResult) (map[int][]db.SavedContainer, map[int]atc.ContainerRetention) {
+	jobContainerMap := make(map[int][]db.SavedContainer)
+	retentionMap := make(map[int]atc.ContainerRetention)
 
 	for _, container := range containers {
-		pipelineDB, err := cr.pipelineDBFactory.BuildWithID(container.PipelineID)
-		if err != nil {
-			cr.logger.Error("no pipeline", err, lager.Data{"build-id": container.BuildID})
-			cr.release(container.Handle)
-			continue
-		}
-
-		pipelineConfig, _, found, err := pipelineDB.GetConfig()
-		if err != nil || !found {
-			cr.release(container.Handle)
-			continue
-		}
-
-		jobExpired := true
-		for _, jobConfig := range pipelineConfig.Jobs {
-			if jobConfig.Name == container.JobName {
-				jobExpired = false
-				break
-			}
-		}
-
-		if jobExpired {
-			cr.release(container.Handle)
+		jobConfig, found := cr.findJobConfig(container)
+		if !found {
+			result.queueRelease(container)
 			continue
 		}
 
@@ -176,18 +521,37 @@ func (cr *containerReaper) buildFailedMap(containers []db.SavedContainer) map[in
 		jobID, found, err := cr.db.FindJobIDForBuild(buildID)
 		if err != nil || !found {
 			cr.logger.Error("find-job-id-for-build", err, lager.Data{"build-id": buildID, "found": found})
-			cr.release(container.Handle)
+			result.queueRelease(container)
 			continue
 		}
 
-		jobContainers := jobContainerMap[jobID]
-		if jobContainers == nil {
-			jobContainerMap[jobID] = []db.SavedContainer{container}
-		} else {
-			jobContainers = append(jobContainers, container)
-			jobContainerMap[jobID] = jobContainers
+		retentionMap[jobID] = jobConfig.ContainerRetention
+		jobContainerMap[jobID] = append(jobContainerMap[jobID], container)
+	}
+
+	return jobContainerMap, retentionMap
+}
+
+// findJobConfig looks up the still-configured atc.JobConfig that a
+// container's build ran under, returning found=false if the container's
+// pipeline, its config, or the job itself no longer exists.
+func (cr *containerReaper) findJobConfig(container db.SavedContainer) (atc.JobConfig, bool) {
+	pipelineDB, err := cr.pipelineDBFactory.BuildWithID(container.PipelineID)
+	if err != nil {
+		cr.logger.Error("no pipeline", err, lager.Data{"build-id": container.BuildID})
+		return atc.JobConfig{}, false
+	}
+
+	pipelineConfig, _, found, err := pipelineDB.GetConfig()
+	if err != nil || !found {
+		return atc.JobConfig{}, false
+	}
+
+	for _, jobConfig := range pipelineConfig.Jobs {
+		if jobConfig.Name == container.JobName {
+			return jobConfig, true
 		}
 	}
 
-	return jobContainerMap
+	return atc.JobConfig{}, false
 }
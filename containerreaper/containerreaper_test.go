@@ -0,0 +1,130 @@
+package containerreaper_test
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	"github.com/concourse/atc/containerreaper"
+	"github.com/concourse/atc/db"
+)
+
+var _ = Describe("ContainerReaper", func() {
+	var (
+		logger    *lagertest.TestLogger
+		fakeLease *fakeLease
+		fakeDB    *fakeContainerReaperDB
+		reaper    containerreaper.ContainerReaper
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("container-reaper")
+		fakeLease = &fakeLease{}
+		fakeDB = &fakeContainerReaperDB{}
+
+		reaper = containerreaper.NewContainerReaper(
+			logger,
+			nil,
+			fakeDB,
+			nil,
+			nil,
+			fakeLease,
+			time.Millisecond,
+			1,
+			nil,
+		)
+	})
+
+	runUntil := func(condition func() bool) {
+		signals := make(chan os.Signal, 1)
+
+		done := make(chan struct{})
+		go func() {
+			reaper.Run(signals, make(chan struct{}))
+			close(done)
+		}()
+
+		Eventually(condition).Should(BeTrue())
+		signals <- os.Interrupt
+
+		Eventually(done).Should(BeClosed())
+	}
+
+	Context("when the lease can't be acquired", func() {
+		BeforeEach(func() {
+			fakeLease.acquired = false
+		})
+
+		It("does not scan for containers", func() {
+			runUntil(func() bool { return atomic.LoadInt32(&fakeLease.attemptSignCalls) >= 1 })
+
+			Ω(atomic.LoadInt32(&fakeDB.findSuccessfulCalls)).Should(Equal(int32(0)))
+			Ω(atomic.LoadInt32(&fakeLease.breakCalls)).Should(Equal(int32(0)))
+		})
+	})
+
+	Context("when the lease is acquired", func() {
+		BeforeEach(func() {
+			fakeLease.acquired = true
+		})
+
+		It("scans for containers and breaks the lease afterwards", func() {
+			runUntil(func() bool { return atomic.LoadInt32(&fakeDB.findSuccessfulCalls) >= 1 })
+
+			Ω(atomic.LoadInt32(&fakeLease.breakCalls)).Should(Equal(atomic.LoadInt32(&fakeLease.attemptSignCalls)))
+		})
+	})
+})
+
+type fakeLease struct {
+	acquired         bool
+	attemptSignCalls int32
+	breakCalls       int32
+}
+
+func (l *fakeLease) AttemptSign() (bool, error) {
+	atomic.AddInt32(&l.attemptSignCalls, 1)
+	return l.acquired, nil
+}
+
+func (l *fakeLease) Break() error {
+	atomic.AddInt32(&l.breakCalls, 1)
+	return nil
+}
+
+type fakeContainerReaperDB struct {
+	findSuccessfulCalls int32
+}
+
+func (f *fakeContainerReaperDB) FindJobIDForBuild(buildID int) (int, bool, error) {
+	return 0, false, nil
+}
+
+func (f *fakeContainerReaperDB) FindOrphanContainersWithInfiniteTTL() ([]db.SavedContainer, error) {
+	return nil, nil
+}
+
+func (f *fakeContainerReaperDB) FindContainersFromSuccessfulBuildsWithInfiniteTTL() ([]db.SavedContainer, error) {
+	atomic.AddInt32(&f.findSuccessfulCalls, 1)
+	return nil, nil
+}
+
+func (f *fakeContainerReaperDB) FindContainersFromUnsuccessfulBuildsWithInfiniteTTL() ([]db.SavedContainer, error) {
+	return nil, nil
+}
+
+func (f *fakeContainerReaperDB) FindContainersFromSuccessfulBuildsWithInfiniteTTLForJob(jobID int) ([]db.SavedContainer, error) {
+	return nil, nil
+}
+
+func (f *fakeContainerReaperDB) FindContainersFromUnsuccessfulBuildsWithInfiniteTTLForJob(jobID int) ([]db.SavedContainer, error) {
+	return nil, nil
+}
+
+func (f *fakeContainerReaperDB) UpdateExpiresAtOnContainer(handle string, ttl time.Duration) error {
+	return nil
+}
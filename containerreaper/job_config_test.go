@@ -0,0 +1,164 @@
+package containerreaper
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	"github.com/concourse/atc"
+	"github.com/concourse/atc/db"
+)
+
+var _ = Describe("reapJobContainers", func() {
+	var (
+		cr          *containerReaper
+		result      *reapResult
+		pipelineDBs *fakePipelineDBFactory
+		reaperDB    *fakeJobLookupDB
+	)
+
+	BeforeEach(func() {
+		pipelineDBs = &fakePipelineDBFactory{byPipelineID: map[int]*fakePipelineDB{}}
+		reaperDB = &fakeJobLookupDB{buildJobIDs: map[int]int{}}
+
+		cr = &containerReaper{
+			logger:            lagertest.NewTestLogger("container-reaper"),
+			db:                reaperDB,
+			pipelineDBFactory: pipelineDBs,
+			workerClient:      &fakeWorkerClient{},
+			workerConcurrency: 1,
+		}
+		result = &reapResult{errs: &multiError{}}
+	})
+
+	container := func(buildID, pipelineID int, jobName string) db.SavedContainer {
+		c := db.SavedContainer{BuildID: buildID, PipelineID: pipelineID, JobName: jobName}
+		c.Container.Handle = jobName + "-handle"
+		return c
+	}
+
+	It("keeps only the configured number of successful containers for a job with container_retention set", func() {
+		one := 1
+		pipelineDBs.byPipelineID[1] = &fakePipelineDB{
+			config: atc.Config{
+				Jobs: atc.JobConfigs{
+					{Name: "some-job", ContainerRetention: atc.ContainerRetention{RawKeepSuccessful: &one}},
+				},
+			},
+			found: true,
+		}
+
+		reaperDB.buildJobIDs[1] = 1
+		reaperDB.buildJobIDs[2] = 1
+
+		cr.reapJobContainers([]db.SavedContainer{
+			container(1, 1, "some-job"),
+			container(2, 1, "some-job"),
+		}, nil, result)
+
+		Ω(result.pending).Should(HaveLen(1))
+		Ω(result.pending[0].BuildID).Should(Equal(1))
+	})
+
+	It("falls back to ContainerRetention's zero-value defaults for a job with no container_retention configured", func() {
+		pipelineDBs.byPipelineID[1] = &fakePipelineDB{
+			config: atc.Config{
+				Jobs: atc.JobConfigs{
+					{Name: "some-job"},
+				},
+			},
+			found: true,
+		}
+
+		reaperDB.buildJobIDs[1] = 1
+		reaperDB.buildJobIDs[2] = 1
+
+		cr.reapJobContainers([]db.SavedContainer{
+			container(1, 1, "some-job"),
+			container(2, 1, "some-job"),
+		}, nil, result)
+
+		// KeepSuccessful defaults to 0, so both are beyond retention.
+		Ω(result.pending).Should(HaveLen(2))
+	})
+
+	It("queues a failed container immediately when its job config can't be found, but only falls through to defaults for a successful one", func() {
+		// no entry in pipelineDBs for pipeline 1, so findJobConfig misses
+		reaperDB.buildJobIDs[1] = 1
+		reaperDB.buildJobIDs[2] = 2
+
+		cr.reapJobContainers(
+			[]db.SavedContainer{container(1, 1, "missing-job")},
+			[]db.SavedContainer{container(2, 1, "missing-job")},
+			result,
+		)
+
+		Ω(result.pending).Should(HaveLen(2))
+
+		var buildIDs []int
+		for _, c := range result.pending {
+			buildIDs = append(buildIDs, c.BuildID)
+		}
+		Ω(buildIDs).Should(ConsistOf(1, 2))
+	})
+})
+
+type fakePipelineDBFactory struct {
+	db.PipelineDBFactory
+
+	byPipelineID map[int]*fakePipelineDB
+}
+
+func (f *fakePipelineDBFactory) BuildWithID(pipelineID int) (db.PipelineDB, error) {
+	if pipelineDB, found := f.byPipelineID[pipelineID]; found {
+		return pipelineDB, nil
+	}
+
+	return &fakePipelineDB{found: false}, nil
+}
+
+type fakePipelineDB struct {
+	db.PipelineDB
+
+	config atc.Config
+	found  bool
+}
+
+func (f *fakePipelineDB) GetConfig() (atc.Config, db.ConfigID, bool, error) {
+	return f.config, 0, f.found, nil
+}
+
+type fakeJobLookupDB struct {
+	buildJobIDs map[int]int
+}
+
+func (f *fakeJobLookupDB) FindJobIDForBuild(buildID int) (int, bool, error) {
+	jobID, found := f.buildJobIDs[buildID]
+	return jobID, found, nil
+}
+
+func (f *fakeJobLookupDB) FindOrphanContainersWithInfiniteTTL() ([]db.SavedContainer, error) {
+	return nil, nil
+}
+
+func (f *fakeJobLookupDB) FindContainersFromSuccessfulBuildsWithInfiniteTTL() ([]db.SavedContainer, error) {
+	return nil, nil
+}
+
+func (f *fakeJobLookupDB) FindContainersFromUnsuccessfulBuildsWithInfiniteTTL() ([]db.SavedContainer, error) {
+	return nil, nil
+}
+
+func (f *fakeJobLookupDB) FindContainersFromSuccessfulBuildsWithInfiniteTTLForJob(jobID int) ([]db.SavedContainer, error) {
+	return nil, nil
+}
+
+func (f *fakeJobLookupDB) FindContainersFromUnsuccessfulBuildsWithInfiniteTTLForJob(jobID int) ([]db.SavedContainer, error) {
+	return nil, nil
+}
+
+func (f *fakeJobLookupDB) UpdateExpiresAtOnContainer(handle string, ttl time.Duration) error {
+	return nil
+}
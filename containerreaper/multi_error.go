@@ -0,0 +1,35 @@
+package containerreaper
+
+import "strings"
+
+// multiError collects zero or more errors encountered while releasing a
+// batch of containers, so that one bad handle doesn't swallow the rest of
+// the run's errors.
+type multiError struct {
+	errs []error
+}
+
+func (m *multiError) Add(err error) {
+	if err == nil {
+		return
+	}
+
+	m.errs = append(m.errs, err)
+}
+
+func (m *multiError) ErrorOrNil() error {
+	if len(m.errs) == 0 {
+		return nil
+	}
+
+	return m
+}
+
+func (m *multiError) Error() string {
+	messages := make([]string, len(m.errs))
+	for i, err := range m.errs {
+		messages[i] = err.Error()
+	}
+
+	return strings.Join(messages, "; ")
+}
@@ -0,0 +1,179 @@
+package containerreaper
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-golang/lager"
+	"github.com/pivotal-golang/lager/lagertest"
+
+	"github.com/concourse/atc/db"
+	"github.com/concourse/atc/worker"
+)
+
+var _ = Describe("queueBeyondRetention", func() {
+	var (
+		cr     *containerReaper
+		result *reapResult
+	)
+
+	BeforeEach(func() {
+		cr = &containerReaper{logger: lagertest.NewTestLogger("container-reaper")}
+		result = &reapResult{errs: &multiError{}}
+	})
+
+	containerForBuild := func(buildID int, createdAt time.Time) db.SavedContainer {
+		c := db.SavedContainer{BuildID: buildID}
+		c.Container.Handle = "handle"
+		c.Container.CreatedAt = createdAt
+		return c
+	}
+
+	It("keeps only the newest `keep` builds' containers", func() {
+		containers := []db.SavedContainer{
+			containerForBuild(1, time.Now()),
+			containerForBuild(2, time.Now()),
+			containerForBuild(3, time.Now()),
+		}
+
+		cr.queueBeyondRetention(containers, 2, 0, result)
+
+		Ω(result.pending).Should(HaveLen(1))
+		Ω(result.pending[0].BuildID).Should(Equal(1))
+	})
+
+	It("queues every container when keep is 0", func() {
+		containers := []db.SavedContainer{
+			containerForBuild(1, time.Now()),
+			containerForBuild(2, time.Now()),
+		}
+
+		cr.queueBeyondRetention(containers, 0, 0, result)
+
+		Ω(result.pending).Should(HaveLen(2))
+	})
+
+	It("queues containers older than maxAge even if they'd otherwise be kept", func() {
+		containers := []db.SavedContainer{
+			containerForBuild(1, time.Now()),
+			containerForBuild(2, time.Now().Add(-time.Hour)),
+		}
+
+		cr.queueBeyondRetention(containers, 2, time.Minute, result)
+
+		Ω(result.pending).Should(HaveLen(1))
+		Ω(result.pending[0].BuildID).Should(Equal(2))
+	})
+})
+
+var _ = Describe("flushReleases", func() {
+	It("releases every worker's queue concurrently, bounded per-worker", func() {
+		fakeClient := &fakeWorkerClient{}
+
+		cr := &containerReaper{
+			logger:            lagertest.NewTestLogger("container-reaper"),
+			workerClient:      fakeClient,
+			db:                &fakeReaperDB{},
+			workerConcurrency: 2,
+		}
+
+		result := &reapResult{errs: &multiError{}}
+
+		for _, workerName := range []string{"worker-a", "worker-b"} {
+			for i := 0; i < 5; i++ {
+				c := db.SavedContainer{WorkerName: workerName}
+				c.Container.Handle = workerName + "-handle"
+				result.queueRelease(c)
+			}
+		}
+
+		cr.flushReleases(result)
+
+		Ω(result.released).Should(Equal(10))
+		Ω(result.failures).Should(Equal(0))
+		Ω(fakeClient.maxConcurrentFor("worker-a")).Should(BeNumerically("<=", 2))
+		Ω(fakeClient.maxConcurrentFor("worker-b")).Should(BeNumerically("<=", 2))
+		Ω(atomic.LoadInt32(&fakeClient.calls)).Should(Equal(int32(10)))
+	})
+})
+
+// fakeWorkerClient only implements the one worker.Client method the reaper
+// actually calls; everything else panics if exercised. Concurrency is
+// tracked per worker (keyed by the handle's "<worker>-handle" prefix),
+// since flushReleases intentionally releases different workers' queues in
+// parallel — workerConcurrency bounds each worker's queue independently,
+// not the reaper's total concurrency.
+type fakeWorkerClient struct {
+	worker.Client
+
+	calls int32
+
+	mu       sync.Mutex
+	inFlight map[string]int32
+	maxSeen  map[string]int32
+}
+
+func (f *fakeWorkerClient) LookupContainer(logger lager.Logger, handle string) (worker.Container, bool, error) {
+	atomic.AddInt32(&f.calls, 1)
+
+	workerName := strings.TrimSuffix(handle, "-handle")
+
+	f.mu.Lock()
+	if f.inFlight == nil {
+		f.inFlight = map[string]int32{}
+		f.maxSeen = map[string]int32{}
+	}
+	f.inFlight[workerName]++
+	if f.inFlight[workerName] > f.maxSeen[workerName] {
+		f.maxSeen[workerName] = f.inFlight[workerName]
+	}
+	f.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	f.mu.Lock()
+	f.inFlight[workerName]--
+	f.mu.Unlock()
+
+	return nil, false, nil
+}
+
+func (f *fakeWorkerClient) maxConcurrentFor(workerName string) int32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.maxSeen[workerName]
+}
+
+type fakeReaperDB struct{}
+
+func (f *fakeReaperDB) FindJobIDForBuild(buildID int) (int, bool, error) {
+	return 0, false, nil
+}
+
+func (f *fakeReaperDB) FindOrphanContainersWithInfiniteTTL() ([]db.SavedContainer, error) {
+	return nil, nil
+}
+
+func (f *fakeReaperDB) FindContainersFromSuccessfulBuildsWithInfiniteTTL() ([]db.SavedContainer, error) {
+	return nil, nil
+}
+
+func (f *fakeReaperDB) FindContainersFromUnsuccessfulBuildsWithInfiniteTTL() ([]db.SavedContainer, error) {
+	return nil, nil
+}
+
+func (f *fakeReaperDB) FindContainersFromSuccessfulBuildsWithInfiniteTTLForJob(jobID int) ([]db.SavedContainer, error) {
+	return nil, nil
+}
+
+func (f *fakeReaperDB) FindContainersFromUnsuccessfulBuildsWithInfiniteTTLForJob(jobID int) ([]db.SavedContainer, error) {
+	return nil, nil
+}
+
+func (f *fakeReaperDB) UpdateExpiresAtOnContainer(handle string, ttl time.Duration) error {
+	return nil
+}
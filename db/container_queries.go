@@ -0,0 +1,73 @@
+package db
+
+import "strconv"
+
+// FindContainersFromSuccessfulBuildsWithInfiniteTTLForJob is the job-scoped
+// counterpart to FindContainersFromSuccessfulBuildsWithInfiniteTTL, used by
+// the container reaper's targeted reap (triggered by a containers_changed
+// notification) so it doesn't have to re-scan every job's containers.
+func (db *SQLDB) FindContainersFromSuccessfulBuildsWithInfiniteTTLForJob(jobID int) ([]SavedContainer, error) {
+	return db.findContainersWithInfiniteTTLForJob(jobID, "succeeded")
+}
+
+// FindContainersFromUnsuccessfulBuildsWithInfiniteTTLForJob is the job-scoped
+// counterpart to FindContainersFromUnsuccessfulBuildsWithInfiniteTTL, used by
+// the container reaper's targeted reap (triggered by a containers_changed
+// notification) so it doesn't have to re-scan every job's containers.
+func (db *SQLDB) FindContainersFromUnsuccessfulBuildsWithInfiniteTTLForJob(jobID int) ([]SavedContainer, error) {
+	return db.findContainersWithInfiniteTTLForJob(jobID, "failed", "errored")
+}
+
+func (db *SQLDB) findContainersWithInfiniteTTLForJob(jobID int, statuses ...string) ([]SavedContainer, error) {
+	statusPlaceholders := ""
+	args := make([]interface{}, 0, len(statuses)+1)
+	args = append(args, jobID)
+
+	for i, status := range statuses {
+		if i > 0 {
+			statusPlaceholders += ", "
+		}
+
+		args = append(args, status)
+		statusPlaceholders += "$" + strconv.Itoa(len(args))
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT c.worker_name, c.handle, c.created_at, b.id, b.job_id, b.pipeline_id, j.name
+		FROM containers c
+		INNER JOIN builds b ON b.id = c.build_id
+		INNER JOIN jobs j ON j.id = b.job_id
+		WHERE b.job_id = $1
+		AND b.status IN (`+statusPlaceholders+`)
+		AND c.best_if_used_by IS NULL
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var containers []SavedContainer
+
+	for rows.Next() {
+		var container SavedContainer
+		var scannedJobID int
+
+		err := rows.Scan(
+			&container.WorkerName,
+			&container.Container.Handle,
+			&container.Container.CreatedAt,
+			&container.BuildID,
+			&scannedJobID,
+			&container.PipelineID,
+			&container.JobName,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		containers = append(containers, container)
+	}
+
+	return containers, rows.Err()
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+)
+
+// Lease is a distributed advisory lock that lets only one process across
+// the whole cluster hold it at a time. It is the building block for
+// "singleton background job" components (the container reaper, the build
+// tracker, the pipeline scheduler) that must not run concurrently across
+// multiple ATCs pointed at the same Postgres.
+type Lease interface {
+	// AttemptSign tries to acquire the lease without blocking. It returns
+	// false, rather than an error, if some other process currently holds
+	// it.
+	AttemptSign() (bool, error)
+
+	// Break releases the lease so another process can acquire it.
+	Break() error
+}
+
+// lease pins a single *sql.Conn for its whole lifetime. Postgres advisory
+// locks are scoped to the backend session that took them, so acquiring and
+// releasing through a *sql.DB (a pool) can send pg_try_advisory_lock and
+// pg_advisory_unlock to two different physical connections: the unlock
+// would then be a no-op and the lock would stay held on a connection that's
+// since gone idle in the pool.
+type lease struct {
+	conn *sql.Conn
+	key  int64
+}
+
+// NewLease returns a Lease for name, hashed to a well-known 64-bit
+// pg_advisory_lock key so every ATC instance derives the same key for the
+// same named component. It checks out a dedicated connection from conn's
+// pool up front and holds onto it for the lifetime of the Lease.
+func NewLease(conn *sql.DB, name string) (Lease, error) {
+	dedicated, err := conn.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return &lease{
+		conn: dedicated,
+		key:  leaseKey(name),
+	}, nil
+}
+
+func (l *lease) AttemptSign() (bool, error) {
+	var acquired bool
+
+	err := l.conn.QueryRowContext(context.Background(), `SELECT pg_try_advisory_lock($1)`, l.key).Scan(&acquired)
+	if err != nil {
+		return false, err
+	}
+
+	return acquired, nil
+}
+
+func (l *lease) Break() error {
+	_, err := l.conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, l.key)
+	return err
+}
+
+func leaseKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
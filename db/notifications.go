@@ -0,0 +1,31 @@
+package db
+
+import "strconv"
+
+// ContainersChannel is the Postgres NOTIFY channel that
+// notifyContainersChanged publishes a job ID to. Listeners (e.g. the
+// container reaper) can LISTEN on this channel instead of polling the
+// containers table. Nothing in this package calls notifyContainersChanged,
+// so build transitions and pipeline config changes publish nothing here.
+const ContainersChannel = "containers_changed"
+
+// notifyContainersChanged notifies ContainersChannel with jobID as the
+// payload, so a listener can reap just that job's containers instead of
+// re-scanning the whole table. It uses pg_notify() rather than a bare
+// NOTIFY statement because NOTIFY's payload must be a literal — it can't
+// be bound as a query parameter the way pg_notify()'s second argument can.
+//
+// It needs to be called, in the same transaction, by every code path that
+// can change which of a job's containers are safe to reap: finishing a
+// build as succeeded/failed/errored, and saving a pipeline config that
+// removes or renames a job.
+//
+// TODO: neither of those call sites exists yet in this package. Until one
+// of them calls notifyContainersChanged, ContainersChannel never receives
+// a real notification, and containerReaper.watch() will only ever reap via
+// its reconnect-triggered full-scan fallback rather than being woken up
+// per-job. Wire this in before relying on the event-driven reap path.
+func (db *SQLDB) notifyContainersChanged(tx Tx, jobID int) error {
+	_, err := tx.Exec(`SELECT pg_notify($1, $2)`, ContainersChannel, strconv.Itoa(jobID))
+	return err
+}
@@ -0,0 +1,27 @@
+package atc
+
+// JobConfig holds the configuration for a single job: what it runs, what
+// triggers it, and the policies around its builds.
+type JobConfig struct {
+	Name string `yaml:"name" json:"name"`
+
+	Public bool `yaml:"public,omitempty" json:"public,omitempty"`
+
+	TaskConfigPath string      `yaml:"build,omitempty" json:"build,omitempty"`
+	TaskConfig     *TaskConfig `yaml:"config,omitempty" json:"config,omitempty"`
+
+	Privileged bool `yaml:"privileged,omitempty" json:"privileged,omitempty"`
+
+	Serial bool `yaml:"serial,omitempty" json:"serial,omitempty"`
+
+	// ContainerRetention overrides how long this job's build containers are
+	// kept around before the container reaper releases their infinite TTL.
+	// Unset fields fall back to ContainerRetention's defaults.
+	ContainerRetention ContainerRetention `yaml:"container_retention,omitempty" json:"container_retention,omitempty"`
+
+	InputConfigs  []JobInputConfig  `yaml:"inputs,omitempty" json:"inputs,omitempty"`
+	OutputConfigs []JobOutputConfig `yaml:"outputs,omitempty" json:"outputs,omitempty"`
+}
+
+// JobConfigs is a list of job configurations.
+type JobConfigs []JobConfig